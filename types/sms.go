@@ -1,11 +1,17 @@
 package types
 
 import (
+	"encoding/base64"
 	"encoding/xml"
-	"log"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nyaruka/phonenumbers"
 	"github.com/pkg/errors"
 	"github.com/xeals/signal-back/signal"
 )
@@ -56,6 +62,7 @@ type SMS struct {
 type MMS struct {
 	XMLName      xml.Name  `xml:"mms"`
 	Parts        []MMSPart `xml:"parts,attr"`
+	Addrs        Addresses `xml:"addrs"`
 	TextOnly     *uint64   `xml:"text_only,attr"`     // optional
 	Sub          *string   `xml:"sub,attr"`           // optional
 	RetrSt       string    `xml:"retr_st,attr"`       // required
@@ -92,6 +99,48 @@ type MMS struct {
 	ContactName  *string   `xml:"contact_name,attr"`  // optional
 }
 
+// AddressType is the PduHeaders party role of an MMS address, as defined by
+// the Android telephony provider and used by the SMS Backup & Restore XML
+// schema.
+type AddressType uint64
+
+// MMS address types.
+const (
+	AddressBCC  AddressType = 129
+	AddressFrom AddressType = 137
+	AddressCC   AddressType = 130
+	AddressTo   AddressType = 151
+)
+
+// Addresses holds every party (sender and recipients) on an MMS message.
+type Addresses struct {
+	XMLName xml.Name  `xml:"addrs"`
+	Address []Address `xml:"addr"`
+}
+
+// Address is a single party on an MMS message.
+type Address struct {
+	XMLName xml.Name    `xml:"addr"`
+	Address string      `xml:"address,attr"` // required
+	Type    AddressType `xml:"type,attr"`    // required
+	Charset uint64      `xml:"charset,attr"` // required
+	Text    string      `xml:",chardata"`
+}
+
+// PartOptions controls how MMSPart attachment payloads are embedded when
+// converting a backup's `part` rows to XML.
+type PartOptions struct {
+	// MaxInlineSize is the largest attachment, in bytes, that will be
+	// embedded directly into the XML as base64. Attachments larger than
+	// this are written to AttachmentDir instead and referenced by
+	// filename via the part's `cl` attribute. Zero means embed every
+	// attachment regardless of size.
+	MaxInlineSize uint64
+	// AttachmentDir is the directory externalized attachments are written
+	// to. It is created if it doesn't already exist.
+	AttachmentDir string
+}
+
 // MMSPart holds a data blob for an MMS.
 type MMSPart struct {
 	XMLName xml.Name `xml:"part"`
@@ -109,8 +158,56 @@ type MMSPart struct {
 	Data    *string  `xml:"data,attr"`  // optional
 }
 
+// Context carries per-conversion configuration through the statement-to-XML
+// pipeline, replacing what would otherwise be package-level globals.
+type Context struct {
+	// Normalizer canonicalizes addresses into E.164 phone numbers. A nil
+	// Normalizer leaves addresses untouched.
+	Normalizer *Normalizer
+	// Parts controls how MMS attachment payloads are embedded.
+	Parts PartOptions
+}
+
+// Normalizer canonicalizes phone numbers into E.164 using a default region.
+type Normalizer struct {
+	// DefaultRegion is the ISO-3166-1 alpha-2 region used to resolve
+	// numbers that aren't already in international format, e.g. "AU".
+	DefaultRegion string
+}
+
+// Normalize returns addr canonicalized to E.164. If addr can't be parsed as
+// a phone number (for instance because it's a Signal UUID, or malformed),
+// it is returned unchanged rather than erroring.
+func (n *Normalizer) Normalize(addr string) string {
+	if n == nil || addr == "" {
+		return addr
+	}
+	num, err := phonenumbers.Parse(addr, n.DefaultRegion)
+	if err != nil {
+		return addr
+	}
+	return phonenumbers.Format(num, phonenumbers.E164)
+}
+
+// normalizeAddress applies ctx's Normalizer to addr, if one is configured.
+func normalizeAddress(ctx *Context, addr string) string {
+	if ctx == nil || ctx.Normalizer == nil {
+		return addr
+	}
+	return ctx.Normalizer.Normalize(addr)
+}
+
+// partOptions returns ctx's PartOptions, or the zero value (embed every
+// attachment inline) if ctx is nil.
+func partOptions(ctx *Context) PartOptions {
+	if ctx == nil {
+		return PartOptions{}
+	}
+	return ctx.Parts
+}
+
 // NewSMSFromStatement constructs an XML SMS struct from a SQL statement.
-func NewSMSFromStatement(stmt *signal.SqlStatement) (*SMS, error) {
+func NewSMSFromStatement(stmt *signal.SqlStatement, ctx *Context) (*SMS, error) {
 	sms := StatementToSMS(stmt)
 	if sms == nil {
 		return nil, errors.Errorf("expected 22 columns for SMS, have %v", len(stmt.GetParameters()))
@@ -127,10 +224,14 @@ func NewSMSFromStatement(stmt *signal.SqlStatement) (*SMS, error) {
 	}
 
 	if sms.Address != nil {
-		xml.Address = *sms.Address
+		xml.Address = normalizeAddress(ctx, *sms.Address)
 	}
 	if sms.Type != nil {
-		xml.Type = translateSMSType(*sms.Type)
+		t, err := translateSMSType(*sms.Type)
+		if err != nil {
+			return nil, err
+		}
+		xml.Type = t
 	}
 	if sms.Body != nil {
 		xml.Body = *sms.Body
@@ -145,17 +246,299 @@ func NewSMSFromStatement(stmt *signal.SqlStatement) (*SMS, error) {
 	return &xml, nil
 }
 
-func NewMMSFromStatement(stmt *signal.SqlStatement) (*MMS, error) {
+// NewMMSFromStatement constructs an XML MMS struct from a SQL statement,
+// joining in the `part` and `mms_addresses` rows that belong to the same
+// message so the result carries its attachments and participant list.
+func NewMMSFromStatement(stmt *signal.SqlStatement, parts []*signal.SqlStatement, addresses []*signal.SqlStatement, attachments map[string][]byte, ctx *Context) (*MMS, error) {
 	mms := StatementToMMS(stmt)
 	if mms == nil {
 		return nil, errors.Errorf("expected 42 columns for MMS, have %v", len(stmt.GetParameters()))
 	}
 
-	xml := MMS{}
+	xml := MMS{
+		TextOnly:     mms.TextOnly,
+		Sub:          mms.Sub,
+		ReadableDate: intToTime(mms.Date),
+		ContactName:  mms.Person,
+	}
+
+	if mms.RetrSt != nil {
+		xml.RetrSt = *mms.RetrSt
+	}
+	if mms.Date != nil {
+		xml.Date = *mms.Date
+	}
+	if mms.CtCls != nil {
+		xml.CtCls = *mms.CtCls
+	}
+	if mms.SubCs != nil {
+		xml.SubCs = *mms.SubCs
+	}
+	if mms.Read != nil {
+		xml.Read = *mms.Read
+	}
+	if mms.CtL != nil {
+		xml.CtL = *mms.CtL
+	}
+	if mms.TrID != nil {
+		xml.TrID = *mms.TrID
+	}
+	if mms.St != nil {
+		xml.St = *mms.St
+	}
+	if mms.MsgBox != nil {
+		xml.MsgBox = *mms.MsgBox
+	}
+	if mms.Address != nil {
+		xml.Address = *mms.Address
+	}
+	if mms.MCls != nil {
+		xml.MCls = *mms.MCls
+	}
+	if mms.DTm != nil {
+		xml.DTm = *mms.DTm
+	}
+	if mms.ReadStatus != nil {
+		xml.ReadStatus = *mms.ReadStatus
+	}
+	if mms.CtT != nil {
+		xml.CtT = *mms.CtT
+	}
+	if mms.RetrTxtCs != nil {
+		xml.RetrTxtCs = *mms.RetrTxtCs
+	}
+	if mms.DRpt != nil {
+		xml.DRpt = *mms.DRpt
+	}
+	if mms.MId != nil {
+		xml.MId = *mms.MId
+	}
+	if mms.DateSent != nil {
+		xml.DateSent = *mms.DateSent
+	}
+	if mms.Seen != nil {
+		xml.Seen = *mms.Seen
+	}
+	if mms.MType != nil {
+		xml.MType = *mms.MType
+	}
+	if mms.V != nil {
+		xml.V = *mms.V
+	}
+	if mms.Exp != nil {
+		xml.Exp = *mms.Exp
+	}
+	if mms.Pri != nil {
+		xml.Pri = *mms.Pri
+	}
+	if mms.Rr != nil {
+		xml.Rr = *mms.Rr
+	}
+	if mms.RespTxt != nil {
+		xml.RespTxt = *mms.RespTxt
+	}
+	if mms.RptA != nil {
+		xml.RptA = *mms.RptA
+	}
+	if mms.Locked != nil {
+		xml.Locked = *mms.Locked
+	}
+	if mms.RetrTxt != nil {
+		xml.RetrTxt = *mms.RetrTxt
+	}
+	if mms.RespSt != nil {
+		xml.RespSt = *mms.RespSt
+	}
+	if mms.MSize != nil {
+		xml.MSize = *mms.MSize
+	}
+
+	for _, p := range parts {
+		part, err := NewMMSPartFromStatement(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing MMS part")
+		}
+		if err := attachMMSPart(&xml, part, attachments, partOptions(ctx)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, a := range addresses {
+		addr, err := NewAddressFromStatement(a, ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing MMS address")
+		}
+		xml.Addrs.Address = append(xml.Addrs.Address, *addr)
+	}
+
+	return &xml, nil
+}
+
+// NewAddressFromStatement constructs an XML Address struct from a SQL
+// statement representing a row of the `mms_addresses` table.
+func NewAddressFromStatement(stmt *signal.SqlStatement, ctx *Context) (*Address, error) {
+	row := StatementToAddress(stmt)
+	if row == nil {
+		return nil, errors.Errorf("expected columns for MMS address, have %v", len(stmt.GetParameters()))
+	}
+
+	xml := Address{}
+	if row.Address != nil {
+		normalized := normalizeAddress(ctx, *row.Address)
+		xml.Address = normalized
+		xml.Text = normalized
+	}
+	if row.Charset != nil {
+		xml.Charset = *row.Charset
+	}
+	if row.Type != nil {
+		t, err := translateAddressType(*row.Type)
+		if err != nil {
+			return nil, err
+		}
+		xml.Type = t
+	}
+
+	return &xml, nil
+}
+
+// translateAddressType validates Signal's mms_addresses.type column, which
+// (mirroring the Android MMS provider it was forked from) already stores
+// the PduHeaders party codes the SMS Backup & Restore schema expects
+// (137 = sender, 151 = recipient, 130 = CC, 129 = BCC) rather than a
+// condensed 0-3 range, so no remapping is needed here.
+func translateAddressType(t uint64) (AddressType, error) {
+	switch AddressType(t) {
+	case AddressFrom, AddressTo, AddressCC, AddressBCC:
+		return AddressType(t), nil
+	default:
+		return 0, errors.Errorf("undefined MMS address type: %#v", t)
+	}
+}
+
+// NewMMSPartFromStatement constructs an XML MMSPart struct from a SQL
+// statement representing a row of the `part` table.
+func NewMMSPartFromStatement(stmt *signal.SqlStatement) (*MMSPart, error) {
+	part := StatementToMMSPart(stmt)
+	if part == nil {
+		return nil, errors.Errorf("expected columns for MMS part, have %v", len(stmt.GetParameters()))
+	}
+
+	xml := MMSPart{}
+	if part.Seq != nil {
+		xml.Seq = *part.Seq
+	}
+	if part.Ct != nil {
+		xml.Ct = *part.Ct
+	}
+	if part.Name != nil {
+		xml.Name = *part.Name
+	}
+	if part.ChSet != nil {
+		xml.ChSet = *part.ChSet
+	}
+	if part.Cd != nil {
+		xml.Cd = *part.Cd
+	}
+	if part.Fn != nil {
+		xml.Fn = *part.Fn
+	}
+	if part.CID != nil {
+		xml.CID = *part.CID
+	}
+	if part.Cl != nil {
+		xml.Cl = *part.Cl
+	}
+	if part.CttS != nil {
+		xml.CttS = *part.CttS
+	}
+	if part.CttT != nil {
+		xml.CttT = *part.CttT
+	}
+	if part.Text != nil {
+		xml.Text = *part.Text
+	}
 
 	return &xml, nil
 }
 
+// attachMMSPart looks up part's attachment by CID, attaches it if found, and
+// appends part onto dst.Parts.
+func attachMMSPart(dst *MMS, part *MMSPart, attachments map[string][]byte, opts PartOptions) error {
+	if data, ok := attachments[part.CID]; ok {
+		if err := attachPartData(part, data, opts); err != nil {
+			return errors.Wrapf(err, "attaching data for MMS part %v", part.CID)
+		}
+	}
+	dst.Parts = append(dst.Parts, *part)
+	return nil
+}
+
+// attachPartData embeds or externalizes an attachment's raw bytes onto part,
+// following opts. Parts with a character set are treated as text and
+// decoded into Text; everything else is embedded as base64, unless it
+// exceeds opts.MaxInlineSize, in which case it is written to
+// opts.AttachmentDir and referenced by filename via Cl instead.
+func attachPartData(part *MMSPart, data []byte, opts PartOptions) error {
+	if part.ChSet != "" && part.ChSet != "0" {
+		part.Text = decodeCharset(data, part.ChSet)
+		return nil
+	}
+
+	if opts.MaxInlineSize > 0 && uint64(len(data)) > opts.MaxInlineSize {
+		fallback := fmt.Sprintf("attachment-%d", part.Seq)
+		name := sanitizeFilename(part.CID, fallback) + filepath.Ext(part.Fn)
+		if err := os.MkdirAll(opts.AttachmentDir, 0755); err != nil {
+			return errors.Wrap(err, "creating attachment directory")
+		}
+		if err := ioutil.WriteFile(filepath.Join(opts.AttachmentDir, name), data, 0644); err != nil {
+			return errors.Wrap(err, "writing externalized attachment")
+		}
+		part.Cl = name
+		return nil
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	part.Data = &encoded
+	return nil
+}
+
+// sanitizeFilename derives a safe on-disk filename from backup-controlled
+// data (a part's cid). The cid comes straight from the backup file, so a
+// corrupted or malicious backup could otherwise smuggle path separators
+// into it and write the externalized attachment outside AttachmentDir. If
+// name turns out to be empty or entirely made of "." after sanitizing, it
+// is replaced with fallback (which callers should make unique per part, so
+// that two degenerate cids don't collide on disk) instead of a fixed name.
+func sanitizeFilename(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+	if strings.Trim(name, ".") == "" {
+		return fallback
+	}
+	return name
+}
+
+// decodeCharset decodes an MMS part body according to its MIBEnum character
+// set. Only ISO-8859-1 (4) needs special handling, since every other
+// charset Signal is known to produce ("106"/UTF-8, or unset) is already
+// valid UTF-8 once read as a plain string.
+func decodeCharset(data []byte, chset string) string {
+	if chset != "4" {
+		return string(data)
+	}
+
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
 func intToTime(n *uint64) *string {
 	if n == nil {
 		return nil
@@ -165,7 +548,7 @@ func intToTime(n *uint64) *string {
 	return &t
 }
 
-func translateSMSType(t uint64) SMSType {
+func translateSMSType(t uint64) (SMSType, error) {
 	// Just get the lowest 5 bits, because everything else is masking.
 	// https://github.com/signalapp/Signal-Android/blob/master/src/org/thoughtcrime/securesms/database/MmsSmsColumns.java
 	v := uint8(t) & 0x1F
@@ -173,39 +556,37 @@ func translateSMSType(t uint64) SMSType {
 	switch v {
 	// STANDARD
 	case 1: // standard standard
-		return SMSReceived
+		return SMSReceived, nil
 	case 2: // standard sent
-		return SMSSent
+		return SMSSent, nil
 	case 3: // standard draft
-		return SMSDraft
+		return SMSDraft, nil
 	case 4: // standard outbox
-		return SMSOutbox
+		return SMSOutbox, nil
 	case 5: // standard failed
-		return SMSFailed
+		return SMSFailed, nil
 	case 6: // standard queued
-		return SMSQueued
+		return SMSQueued, nil
 
 		// SIGNAL
 	case 20: // signal received
-		return SMSReceived
+		return SMSReceived, nil
 	case 21: // signal outbox
-		return SMSOutbox
+		return SMSOutbox, nil
 	case 22: // signal sending
-		return SMSQueued
+		return SMSQueued, nil
 	case 23: // signal sent
-		return SMSSent
+		return SMSSent, nil
 	case 24: // signal failed
-		return SMSFailed
+		return SMSFailed, nil
 	case 25: // pending secure SMS fallback
-		return SMSQueued
+		return SMSQueued, nil
 	case 26: // pending insecure SMS fallback
-		return SMSQueued
+		return SMSQueued, nil
 	case 27: // signal draft
-		return SMSDraft
+		return SMSDraft, nil
 
 	default:
-		log.Fatalf("undefined SMS type: %#v\nplease report this issue, as well as (if possible) details about the SMS,\nsuch as whether it was sent, received, drafted, etc.\n", t)
-		log.Fatalf("note that the output XML may not properly import to Signal\n")
-		return SMSInvalid
+		return SMSInvalid, errors.Errorf("undefined SMS type: %#v\nplease report this issue, as well as (if possible) details about the SMS,\nsuch as whether it was sent, received, drafted, etc.\nnote that the output XML may not properly import to Signal", t)
 	}
 }
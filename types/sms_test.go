@@ -0,0 +1,153 @@
+package types
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	n := &Normalizer{DefaultRegion: "AU"}
+
+	cases := []struct {
+		name string
+		addr string
+		want string
+	}{
+		{"national format resolved via DefaultRegion", "0412345678", "+61412345678"},
+		{"already E.164", "+61412345678", "+61412345678"},
+		{"unparseable string left unchanged", "1b0d1b5e-51d8-4a9e-9c1c-8e6e5f3f2b9a", "1b0d1b5e-51d8-4a9e-9c1c-8e6e5f3f2b9a"},
+	}
+
+	for _, c := range cases {
+		if got := n.Normalize(c.addr); got != c.want {
+			t.Errorf("%s: Normalize(%q) = %q, want %q", c.name, c.addr, got, c.want)
+		}
+	}
+}
+
+func TestTranslateAddressTypePassesThroughPduHeadersCodes(t *testing.T) {
+	for _, want := range []AddressType{AddressFrom, AddressTo, AddressCC, AddressBCC} {
+		got, err := translateAddressType(uint64(want))
+		if err != nil {
+			t.Fatalf("translateAddressType(%d): %v", want, err)
+		}
+		if got != want {
+			t.Fatalf("translateAddressType(%d) = %d, want %d", want, got, want)
+		}
+	}
+}
+
+func TestTranslateAddressTypeRejectsUnknownCode(t *testing.T) {
+	if _, err := translateAddressType(3); err == nil {
+		t.Fatal("expected an error for a condensed 0-3 style code that isn't a real PduHeaders value")
+	}
+}
+
+func TestAttachPartDataExternalizeRejectsPathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signal-back-attach")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	part := &MMSPart{CID: "../../etc/passwd", Fn: "evil.bin"}
+	opts := PartOptions{MaxInlineSize: 1, AttachmentDir: dir}
+
+	if err := attachPartData(part, []byte("payload"), opts); err != nil {
+		t.Fatalf("attachPartData: %v", err)
+	}
+
+	if filepath.Dir(part.Cl) != "." {
+		t.Fatalf("expected a bare filename with no directory components, got %q", part.Cl)
+	}
+
+	written := filepath.Join(dir, part.Cl)
+	if _, err := os.Stat(written); err != nil {
+		t.Fatalf("expected attachment under %s, got: %v", dir, err)
+	}
+}
+
+func TestAttachPartDataExternalizeDisambiguatesFallbackNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signal-back-attach")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := PartOptions{MaxInlineSize: 1, AttachmentDir: dir}
+
+	part1 := &MMSPart{Seq: 1, CID: "..", Fn: "evil1.bin"}
+	if err := attachPartData(part1, []byte("payload one"), opts); err != nil {
+		t.Fatalf("attachPartData: %v", err)
+	}
+	part2 := &MMSPart{Seq: 2, CID: "", Fn: "evil2.bin"}
+	if err := attachPartData(part2, []byte("payload two"), opts); err != nil {
+		t.Fatalf("attachPartData: %v", err)
+	}
+
+	if part1.Cl == part2.Cl {
+		t.Fatalf("expected distinct fallback filenames for two parts, both got %q", part1.Cl)
+	}
+
+	for _, p := range []*MMSPart{part1, part2} {
+		if _, err := os.Stat(filepath.Join(dir, p.Cl)); err != nil {
+			t.Fatalf("expected attachment under %s, got: %v", dir, err)
+		}
+	}
+}
+
+// TestAttachMMSPartJoinsAttachmentsByCID exercises the part/attachment
+// joining logic NewMMSFromStatement delegates to attachMMSPart. It works
+// against already-parsed MMSPart values rather than going through
+// NewMMSFromStatement itself, since that requires a *signal.SqlStatement
+// row and StatementToMMS, neither of which exist in this tree.
+func TestAttachMMSPartJoinsAttachmentsByCID(t *testing.T) {
+	dst := &MMS{MsgBox: 2, Read: 1}
+	attachments := map[string][]byte{"part-1": []byte("hello")}
+
+	part1 := &MMSPart{CID: "part-1"}
+	if err := attachMMSPart(dst, part1, attachments, PartOptions{}); err != nil {
+		t.Fatalf("attachMMSPart: %v", err)
+	}
+	part2 := &MMSPart{CID: "part-2"}
+	if err := attachMMSPart(dst, part2, attachments, PartOptions{}); err != nil {
+		t.Fatalf("attachMMSPart: %v", err)
+	}
+
+	if len(dst.Parts) != 2 {
+		t.Fatalf("expected 2 parts joined onto the MMS, got %d", len(dst.Parts))
+	}
+	wantData := base64.StdEncoding.EncodeToString([]byte("hello"))
+	if dst.Parts[0].Data == nil || *dst.Parts[0].Data != wantData {
+		t.Fatalf("expected part-1's attachment to be embedded as base64, got %+v", dst.Parts[0])
+	}
+	if dst.Parts[1].Data != nil {
+		t.Fatalf("expected part-2 (no matching attachment) to be left without data, got %+v", dst.Parts[1])
+	}
+	if dst.MsgBox != 2 || dst.Read != 1 {
+		t.Fatalf("expected attachMMSPart not to touch unrelated MMS attributes")
+	}
+}
+
+func TestAttachPartDataExternalizeCreatesAttachmentDir(t *testing.T) {
+	base, err := ioutil.TempDir("", "signal-back-attach")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(base)
+
+	dir := filepath.Join(base, "does", "not", "exist", "yet")
+	part := &MMSPart{CID: "part-1", Fn: "photo.jpg"}
+	opts := PartOptions{MaxInlineSize: 1, AttachmentDir: dir}
+
+	if err := attachPartData(part, []byte("payload"), opts); err != nil {
+		t.Fatalf("attachPartData: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, part.Cl)); err != nil {
+		t.Fatalf("expected AttachmentDir to be created and attachment written: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package types
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Item is a sum type wrapping the different kinds of record a backup can
+// stream out. Exactly one field is non-nil.
+type Item struct {
+	SMS        *SMS
+	MMS        *MMS
+	Attachment *Attachment
+	Contact    *Contact
+}
+
+// Attachment is a raw attachment blob, paired with the metadata needed to
+// write it back out to disk or match it against the MMSPart that refers to
+// it.
+type Attachment struct {
+	RowID    uint64
+	UniqueID uint64
+	CID      string
+	Data     []byte
+}
+
+// Contact is a Signal contact or recipient record.
+type Contact struct {
+	Address string
+	Name    string
+}
+
+// Exporter streams decoded backup records, following the same shape as the
+// Timeliner data-source Client.ListItems(ctx, itemChan, opts). Implementing
+// Exporter lets signal-back be used as a library: a caller can feed the
+// stream into a timeline database, a search indexer, or a JSON/NDJSON
+// exporter without ever buffering the whole backup in memory.
+type Exporter interface {
+	// Stream decodes the backup and sends each record on out, closing out
+	// once the backup has been fully read, ctx is cancelled, or an error
+	// occurs. Stream returns any error encountered; partial output may
+	// already have been sent on out by the time it does.
+	Stream(ctx context.Context, out chan<- Item) error
+}
+
+// SliceExporter is a concrete Exporter backed by records already held in
+// memory. It's the reference implementation for callers that build up a
+// backup as a batch rather than decode one frame at a time; a decoder that
+// reads a backup file frame-by-frame should implement Exporter directly
+// and stream from the frame reader instead of pre-building these slices,
+// so as not to reintroduce the buffering WriteXML exists to avoid.
+type SliceExporter struct {
+	SMS []*SMS
+	MMS []*MMS
+}
+
+// Stream sends every SMS, then every MMS, on out, honoring ctx
+// cancellation, and closes out once it's done.
+func (e *SliceExporter) Stream(ctx context.Context, out chan<- Item) error {
+	defer close(out)
+
+	for _, sms := range e.SMS {
+		select {
+		case out <- Item{SMS: sms}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, mms := range e.MMS {
+		select {
+		case out <- Item{MMS: mms}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// countWidth is the width, in digits, reserved for the <smses count="...">
+// placeholder. It's fixed so that patching the real count back in later
+// never changes the length of what was already written. 20 digits covers
+// any uint64.
+const countWidth = 20
+
+// WriteXML drains items from exp and writes them to w as the <smses>
+// document used by the SMS Backup & Restore XML schema, encoding each
+// record as it arrives rather than building the full SMSes slice in
+// memory first. This keeps memory bounded on multi-gigabyte backups, where
+// the previous approach (building an SMSes struct up front) could OOM.
+// Only SMS and MMS items are written; Attachment and Contact items are
+// drained and skipped.
+//
+// The count attribute is only known once every item has been seen, so
+// WriteXML requires w to be seekable (an *os.File, for example) and seeks
+// back to patch it in once streaming finishes. Writing to a non-seekable
+// destination would otherwise silently leave count="0" regardless of how
+// many records were actually written, so that case is rejected outright
+// rather than producing XML that understates itself.
+func WriteXML(ctx context.Context, exp Exporter, w io.WriteSeeker) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	items := make(chan Item)
+	done := make(chan error, 1)
+	doneRead := false
+	go func() { done <- exp.Stream(ctx, items) }()
+
+	// However WriteXML returns, make sure exp.Stream isn't left blocked
+	// sending to items: cancel its context and, on an early return, drain
+	// whatever it still has in flight so it can observe the cancellation
+	// and close the channel.
+	defer func() {
+		cancel()
+		if err != nil {
+			for range items {
+			}
+			if !doneRead {
+				<-done
+			}
+		}
+	}()
+
+	openTag := fmt.Sprintf(`<smses count="%s">`, strings.Repeat("0", countWidth))
+	if _, werr := io.WriteString(w, xml.Header+openTag); werr != nil {
+		err = errors.Wrap(werr, "writing smses open tag")
+		return
+	}
+
+	countOffset, serr := w.Seek(0, io.SeekCurrent)
+	if serr != nil {
+		err = errors.Wrap(serr, "locating smses count placeholder")
+		return
+	}
+	countOffset -= int64(countWidth) + int64(len(`">`))
+
+	enc := xml.NewEncoder(w)
+	var count int
+	for item := range items {
+		var encErr error
+		switch {
+		case item.SMS != nil:
+			encErr = enc.Encode(item.SMS)
+		case item.MMS != nil:
+			encErr = enc.Encode(item.MMS)
+		default:
+			continue
+		}
+		if encErr != nil {
+			err = errors.Wrap(encErr, "encoding item")
+			return
+		}
+		count++
+	}
+
+	streamErr := <-done
+	doneRead = true
+	if streamErr != nil {
+		err = errors.Wrap(streamErr, "streaming backup")
+		return
+	}
+
+	if _, werr := io.WriteString(w, "</smses>"); werr != nil {
+		err = errors.Wrap(werr, "writing smses close tag")
+		return
+	}
+
+	if _, serr := w.Seek(countOffset, io.SeekStart); serr != nil {
+		err = errors.Wrap(serr, "seeking back to patch smses count")
+		return
+	}
+	if _, werr := fmt.Fprintf(w, "%0*d", countWidth, count); werr != nil {
+		err = errors.Wrap(werr, "patching smses count")
+		return
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package types
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteXMLPatchesCountForManyRecords(t *testing.T) {
+	exp := &SliceExporter{}
+	for i := 0; i < 15; i++ {
+		exp.SMS = append(exp.SMS, &SMS{Body: "hi"})
+	}
+
+	f, err := ioutil.TempFile("", "signal-back-smses")
+	if err != nil {
+		t.Fatalf("creating temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := WriteXML(context.Background(), exp, f); err != nil {
+		t.Fatalf("WriteXML: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("reading output: %v", err)
+	}
+
+	if !strings.Contains(string(out), `count="00000000000000000015"`) {
+		t.Fatalf("expected patched count of 15, got: %s", out)
+	}
+	if strings.Count(string(out), "<sms ") != 15 {
+		t.Fatalf("expected 15 <sms> elements, got: %s", out)
+	}
+	if !strings.HasSuffix(string(out), "</smses>") {
+		t.Fatalf("expected output to end with </smses>, got: %s", out)
+	}
+}